@@ -0,0 +1,37 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package options
+
+import "fmt"
+
+// Runtime identifies which container engine pkg/runner should drive.
+type Runtime string
+
+const (
+	// RuntimeDocker drives containers via the Docker Engine API (or the docker CLI as a
+	// fallback). This is the default.
+	RuntimeDocker Runtime = "docker"
+	// RuntimePodman drives containers via podman, for rootless/daemonless hosts.
+	RuntimePodman Runtime = "podman"
+)
+
+// ParseRuntime validates and converts the --runtime flag value into a Runtime.
+func ParseRuntime(s string) (Runtime, error) {
+	switch Runtime(s) {
+	case RuntimeDocker, RuntimePodman:
+		return Runtime(s), nil
+	}
+	return "", fmt.Errorf("invalid --runtime %q, must be one of %q, %q", s, RuntimeDocker, RuntimePodman)
+}
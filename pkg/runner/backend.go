@@ -0,0 +1,182 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Backend abstracts the container engine operations that DockerRunner needs in order to pull
+// images, create and drive containers, and move files in and out of them. Splitting this out lets
+// DockerRunner stay engine-agnostic: DaemonBackend talks to the container engine over its API
+// client, while CLIBackend shells out to its CLI binary for environments where the daemon socket
+// isn't reachable.
+type Backend interface {
+	// PullImage pulls containerImage from its registry.
+	PullImage(containerImage string) error
+	// InspectImage resolves containerImage to a fully qualified reference by digest, e.g.
+	// "ubuntu@sha256:...".
+	InspectImage(containerImage string) (string, error)
+	// ImageEnv returns the environment variables baked into resolvedImage's config, keyed by
+	// variable name. If a key is set more than once, the last value wins.
+	ImageEnv(resolvedImage string) (map[string]string, error)
+	// CreateContainer creates (but does not start) a container from resolvedImage running cmd,
+	// bind-mounting mounts into it, and returns the ID of the created container. mounts must be
+	// set at creation time: most container engines don't support adding mounts to an already
+	// running container.
+	CreateContainer(resolvedImage string, cmd []string, mounts []Mount) (string, error)
+	// StartContainer starts the previously created container identified by containerID.
+	StartContainer(containerID string) error
+	// Exec runs cmd with args inside the running container identified by containerID, as user (or
+	// the image's default user if user is ""), using the given workdir and environment overrides,
+	// and returns the trimmed output. DaemonBackend returns the command's stdout only.
+	Exec(containerID, workdir, user string, env map[string]string, cmd string, args []string) (string, error)
+	// ExecStreaming runs cmd with args inside the running container identified by containerID, as
+	// user (or the image's default user if user is ""), streaming stdout/stderr to the given
+	// writers as they're produced rather than buffering them, and honoring ctx for cancellation.
+	// The returned exitCode is the exited process's exit code, distinct from err: a non-zero
+	// exitCode with a nil err means the command inside the container ran and failed on its own
+	// terms, while a non-nil err means the backend itself failed to run or stream the command (a
+	// client/transport failure).
+	ExecStreaming(ctx context.Context, containerID, workdir, user string, env map[string]string, stdout, stderr io.Writer, cmd string, args []string) (exitCode int, err error)
+	// CopyToContainer copies the local file at src to dst inside the container identified by
+	// containerID.
+	CopyToContainer(containerID, src, dst string) error
+	// CopyFromContainer copies the file at src inside the container identified by containerID to
+	// the local path dst.
+	CopyFromContainer(containerID, src, dst string) error
+	// StopContainer stops the running container identified by containerID.
+	StopContainer(containerID string) error
+	// CommitContainer snapshots the running container identified by containerID as a new image
+	// tagged ref, applying opts, and returns the ID of the committed image. The image is only
+	// tagged locally at this point, so an ID (not a registry digest) is what's available.
+	CommitContainer(containerID, ref string, opts CommitOptions) (string, error)
+	// PushImage pushes ref to its registry, authenticating with auth.
+	PushImage(ref string, auth AuthConfig) error
+}
+
+// Mount describes a host path to bind-mount into a container at creation time, so that
+// extraction scripts can see local content (SDKs, caches, credentials) without baking it into the
+// resulting image.
+type Mount struct {
+	// SourcePath is the path on the host to mount.
+	SourcePath string
+	// DestinationPath is the path inside the container where SourcePath is mounted.
+	DestinationPath string
+	// ReadOnly mounts SourcePath read-only inside the container when true.
+	ReadOnly bool
+}
+
+// CommitOptions configures how a running container is snapshotted into a new image by
+// Backend.CommitContainer.
+type CommitOptions struct {
+	// Author, if set, is recorded as the image author. It is not recorded when Squash is set.
+	Author string
+	// Message, if set, is recorded as the commit message.
+	Message string
+	// Cmd, if non-empty, overrides the image's CMD.
+	Cmd []string
+	// Entrypoint, if non-empty, overrides the image's ENTRYPOINT.
+	Entrypoint []string
+	// Env, if non-empty, overrides or adds to the image's environment.
+	Env map[string]string
+	// Workdir, if set, overrides the image's WORKDIR.
+	Workdir string
+	// Squash flattens the image's full layer history into a single layer, so that files removed
+	// by extraction scripts don't linger in the pushed image.
+	Squash bool
+}
+
+// mergeCommitOptions fills in any of opts' Cmd/Entrypoint/Env/Workdir that weren't explicitly set
+// from the container's own base config (as reported by a "docker inspect" of the image or
+// container). A squashed image is assembled by re-importing a bare filesystem tarball, which
+// starts from a blank config, so without this the image would silently lose whatever its base
+// image contributed (PATH and other ENV, WORKDIR, CMD, ENTRYPOINT) even though opts never asked
+// for any of that to change.
+func mergeCommitOptions(baseCmd, baseEntrypoint, baseEnv []string, baseWorkdir string, opts CommitOptions) CommitOptions {
+	merged := opts
+	if len(merged.Cmd) == 0 {
+		merged.Cmd = baseCmd
+	}
+	if len(merged.Entrypoint) == 0 {
+		merged.Entrypoint = baseEntrypoint
+	}
+	if merged.Workdir == "" {
+		merged.Workdir = baseWorkdir
+	}
+	merged.Env = mergeEnv(baseEnv, merged.Env)
+	return merged
+}
+
+// mergeEnv combines base, a "KEY=VALUE" list as reported by docker inspect, with override, keyed
+// by variable name, with override winning on conflicts. Returns nil if both are empty.
+func mergeEnv(base []string, override map[string]string) map[string]string {
+	if len(base) == 0 && len(override) == 0 {
+		return nil
+	}
+	merged := make(map[string]string, len(base)+len(override))
+	for _, e := range base {
+		kv := strings.SplitN(e, "=", 2)
+		if kv[0] == "" {
+			continue
+		}
+		if len(kv) == 2 {
+			merged[kv[0]] = kv[1]
+		} else {
+			merged[kv[0]] = ""
+		}
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	return merged
+}
+
+// AuthConfig carries registry credentials for Backend.PushImage.
+type AuthConfig struct {
+	// Username to authenticate with.
+	Username string
+	// Password to authenticate with.
+	Password string
+	// ServerAddress is the registry host, e.g. "gcr.io". Empty means the default registry for ref.
+	ServerAddress string
+}
+
+// commitChanges renders opts as Dockerfile-style "--change" strings accepted by both the docker
+// CLI's "commit"/"import" subcommands and the Docker Engine API's ContainerCommitOptions.Changes.
+func commitChanges(opts CommitOptions) []string {
+	var changes []string
+	if len(opts.Cmd) > 0 {
+		if b, err := json.Marshal(opts.Cmd); err == nil {
+			changes = append(changes, fmt.Sprintf("CMD %s", b))
+		}
+	}
+	if len(opts.Entrypoint) > 0 {
+		if b, err := json.Marshal(opts.Entrypoint); err == nil {
+			changes = append(changes, fmt.Sprintf("ENTRYPOINT %s", b))
+		}
+	}
+	for k, v := range opts.Env {
+		changes = append(changes, fmt.Sprintf("ENV %s=%s", k, v))
+	}
+	if opts.Workdir != "" {
+		changes = append(changes, fmt.Sprintf("WORKDIR %s", opts.Workdir))
+	}
+	return changes
+}
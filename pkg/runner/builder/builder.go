@@ -0,0 +1,276 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package builder assembles a running toolchain container from a Dockerfile (or an inline list of
+// instructions) without requiring a "docker build" invocation, following the pattern
+// openshift/imagebuilder established for daemonless Dockerfile execution. RUN becomes
+// runner.DockerRunner.ExecCmd, COPY/ADD become CopyTo, ENV/WORKDIR/USER mutate the runner's
+// exec-time state, ARG feeds ${VAR} expansion, and FROM resolves the base image through the runner package's existing
+// pull/inspect path. This lets config-extraction-time customization be described declaratively in
+// a Dockerfile fragment instead of as a hand-written sequence of ExecCmd calls.
+package builder
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/runner"
+	"github.com/openshift/imagebuilder/dockerfile/command"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+// PendingRuntimeConfig collects the container-runtime-only directives (EXPOSE, HEALTHCHECK, CMD,
+// ENTRYPOINT) seen while evaluating a Dockerfile fragment. These don't affect config extraction,
+// so Builder doesn't execute them, but they're recorded here. Of these, only CMD and ENTRYPOINT
+// carry over into an optional later runner.DockerRunner.Commit (via AsCommitOptions); EXPOSE and
+// HEALTHCHECK are recorded but not applied to the committed image.
+type PendingRuntimeConfig struct {
+	Cmd          []string
+	Entrypoint   []string
+	Healthcheck  []string
+	ExposedPorts []string
+}
+
+// AsCommitOptions converts the recorded directives into the Cmd/Entrypoint fields of a
+// runner.CommitOptions, leaving Author, Message and Squash for the caller to fill in.
+func (p PendingRuntimeConfig) AsCommitOptions() runner.CommitOptions {
+	return runner.CommitOptions{Cmd: p.Cmd, Entrypoint: p.Entrypoint}
+}
+
+// Builder evaluates a Dockerfile fragment against a runner.DockerRunner. Create one with New, then
+// call Build with the Dockerfile content.
+type Builder struct {
+	// Runner is the container the Dockerfile is being evaluated against. It's nil until a FROM
+	// instruction has been evaluated.
+	Runner *runner.DockerRunner
+	// Pending accumulates directives that only affect the eventual image's runtime metadata.
+	Pending PendingRuntimeConfig
+
+	stopContainer bool
+	execOS        string
+	backend       runner.Backend
+
+	env  map[string]string
+	args map[string]string
+}
+
+// New returns a Builder that will resolve its FROM image through runner.NewDockerRunner, using
+// backend to talk to the container engine (nil selects NewDockerRunner's default backend) and execOS to pick
+// the toolchain workdir convention. stopContainer is forwarded to the resulting DockerRunner's
+// Cleanup behavior.
+func New(stopContainer bool, execOS string, backend runner.Backend) *Builder {
+	return &Builder{
+		stopContainer: stopContainer,
+		execOS:        execOS,
+		backend:       backend,
+		env:           map[string]string{},
+		args:          map[string]string{},
+	}
+}
+
+// Build parses dockerfileContent, resolves and starts the container for its FROM image, evaluates
+// each remaining instruction against that container in order, and returns the resulting
+// runner.DockerRunner, ready for config extraction (or a further Commit).
+func (b *Builder) Build(dockerfileContent string) (*runner.DockerRunner, error) {
+	root, err := parser.Parse(strings.NewReader(dockerfileContent))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Dockerfile: %w", err)
+	}
+	for _, node := range root.AST.Children {
+		if err := b.dispatch(node); err != nil {
+			return nil, fmt.Errorf("failed to evaluate %q: %w", node.Original, err)
+		}
+	}
+	return b.Runner, nil
+}
+
+// dispatch evaluates a single top-level Dockerfile instruction node.
+func (b *Builder) dispatch(node *parser.Node) error {
+	switch strings.ToLower(node.Value) {
+	case command.From:
+		return b.evalFrom(node)
+	case command.Run:
+		return b.evalRun(node)
+	case command.Copy, command.Add:
+		return b.evalCopy(node)
+	case command.Env:
+		return b.evalEnv(node)
+	case command.Workdir:
+		return b.evalWorkdir(node)
+	case command.Arg:
+		return b.evalArg(node)
+	case command.User:
+		return b.evalUser(node)
+	case command.Expose, command.Healthcheck, command.Cmd, command.Entrypoint:
+		b.recordRuntimeOnly(node)
+		return nil
+	default:
+		return fmt.Errorf("unsupported Dockerfile instruction %q", node.Value)
+	}
+}
+
+// nodeArgs flattens a parser.Node's linked-list of arguments into a slice, in source order.
+func nodeArgs(node *parser.Node) []string {
+	var args []string
+	for n := node.Next; n != nil; n = n.Next {
+		args = append(args, n.Value)
+	}
+	return args
+}
+
+// expand performs shell-style ${VAR} (and $VAR) expansion against the current ARG map, falling
+// back to the current ENV map, matching how FROM/RUN/COPY/ENV etc. reference earlier ARG/ENV
+// values in a real Dockerfile.
+func (b *Builder) expand(s string) string {
+	return os.Expand(s, func(key string) string {
+		if v, ok := b.args[key]; ok {
+			return v
+		}
+		return b.env[key]
+	})
+}
+
+func (b *Builder) evalFrom(node *parser.Node) error {
+	args := nodeArgs(node)
+	if len(args) == 0 {
+		return fmt.Errorf("FROM requires an image argument")
+	}
+	image := b.expand(args[0])
+	r, err := runner.NewDockerRunner(image, b.stopContainer, b.execOS, b.backend)
+	if err != nil {
+		return fmt.Errorf("failed to resolve FROM image %q: %w", image, err)
+	}
+	b.Runner = r
+	return nil
+}
+
+func (b *Builder) evalRun(node *parser.Node) error {
+	if b.Runner == nil {
+		return fmt.Errorf("RUN seen before FROM")
+	}
+	args := nodeArgs(node)
+	if len(args) == 0 {
+		return fmt.Errorf("RUN requires a command")
+	}
+	var cmd string
+	var cmdArgs []string
+	if node.Attributes["json"] {
+		cmd = b.expand(args[0])
+		for _, a := range args[1:] {
+			cmdArgs = append(cmdArgs, b.expand(a))
+		}
+	} else {
+		// Shell form is handed to the container's own shell verbatim. Pre-expanding it here with
+		// b.expand would run it through os.Expand, which replaces any $VAR this builder doesn't
+		// track (image-provided env like $PATH, or anything set by an earlier RUN) with the empty
+		// string, silently corrupting the command before the shell ever sees it.
+		cmd, cmdArgs = "sh", []string{"-c", strings.Join(args, " ")}
+	}
+	_, err := b.Runner.ExecCmd(cmd, cmdArgs...)
+	return err
+}
+
+func (b *Builder) evalCopy(node *parser.Node) error {
+	if b.Runner == nil {
+		return fmt.Errorf("COPY/ADD seen before FROM")
+	}
+	args := nodeArgs(node)
+	if len(args) < 2 {
+		return fmt.Errorf("COPY/ADD requires at least one source and a destination")
+	}
+	dst := b.expand(args[len(args)-1])
+	for _, src := range args[:len(args)-1] {
+		src = b.expand(src)
+		if err := b.Runner.CopyTo(src, dst); err != nil {
+			return fmt.Errorf("failed to copy %q to %q: %w", src, dst, err)
+		}
+	}
+	return nil
+}
+
+func (b *Builder) evalEnv(node *parser.Node) error {
+	// The parser normalizes both the legacy "ENV key value" form and the new "ENV k1=v1 k2=v2"
+	// form into a flat list of alternating name/value nodes with any "=" already stripped (e.g.
+	// "ENV A=1 B=2" arrives as ["A", "1", "B", "2"]), not as "key=value" tokens to split ourselves.
+	args := nodeArgs(node)
+	if len(args) == 0 || len(args)%2 != 0 {
+		return fmt.Errorf("ENV requires one or more key value pairs")
+	}
+	for i := 0; i < len(args); i += 2 {
+		b.env[args[i]] = b.expand(args[i+1])
+	}
+	if b.Runner != nil {
+		b.Runner.SetAdditionalEnv(b.env)
+	}
+	return nil
+}
+
+func (b *Builder) evalWorkdir(node *parser.Node) error {
+	if b.Runner == nil {
+		return fmt.Errorf("WORKDIR seen before FROM")
+	}
+	args := nodeArgs(node)
+	if len(args) != 1 {
+		return fmt.Errorf("WORKDIR requires exactly one argument")
+	}
+	wd := b.expand(args[0])
+	if _, err := b.Runner.ExecCmd("mkdir", "-p", wd); err != nil {
+		return fmt.Errorf("failed to create WORKDIR %q: %w", wd, err)
+	}
+	b.Runner.SetWorkdir(wd)
+	return nil
+}
+
+func (b *Builder) evalArg(node *parser.Node) error {
+	args := nodeArgs(node)
+	if len(args) == 0 {
+		return fmt.Errorf("ARG requires an argument")
+	}
+	parts := strings.SplitN(args[0], "=", 2)
+	if len(parts) == 2 {
+		b.args[parts[0]] = b.expand(parts[1])
+	} else if _, ok := b.args[parts[0]]; !ok {
+		b.args[parts[0]] = ""
+	}
+	return nil
+}
+
+func (b *Builder) evalUser(node *parser.Node) error {
+	if b.Runner == nil {
+		return fmt.Errorf("USER seen before FROM")
+	}
+	args := nodeArgs(node)
+	if len(args) != 1 {
+		return fmt.Errorf("USER requires exactly one argument")
+	}
+	b.Runner.SetUser(b.expand(args[0]))
+	return nil
+}
+
+// recordRuntimeOnly records a directive that only affects the eventual image's runtime metadata,
+// without executing anything against the running container.
+func (b *Builder) recordRuntimeOnly(node *parser.Node) {
+	args := nodeArgs(node)
+	switch strings.ToLower(node.Value) {
+	case command.Cmd:
+		b.Pending.Cmd = args
+	case command.Entrypoint:
+		b.Pending.Entrypoint = args
+	case command.Healthcheck:
+		b.Pending.Healthcheck = args
+	case command.Expose:
+		b.Pending.ExposedPorts = append(b.Pending.ExposedPorts, args...)
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// CLIBackend implements Backend by shelling out to a docker-compatible CLI binary. It's kept
+// around for environments where this process can't reach the daemon socket directly but the CLI
+// is still on PATH.
+type CLIBackend struct {
+	// binPath is the path to (or name of) the CLI binary to invoke, e.g. "docker".
+	binPath string
+}
+
+// NewCLIBackend returns a CLIBackend that drives containers via the given CLI binary.
+func NewCLIBackend(binPath string) *CLIBackend {
+	return &CLIBackend{binPath: binPath}
+}
+
+func (b *CLIBackend) PullImage(containerImage string) error {
+	_, err := runCmd(b.binPath, "pull", containerImage)
+	return err
+}
+
+func (b *CLIBackend) InspectImage(containerImage string) (string, error) {
+	o, err := runCmd(b.binPath, "inspect", "--format={{index .RepoDigests 0}}", containerImage)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(o), nil
+}
+
+func (b *CLIBackend) ImageEnv(resolvedImage string) (map[string]string, error) {
+	o, err := runCmd(b.binPath, "inspect", "-f", "{{range $i, $v := .Config.Env}}{{println $v}}{{end}}", resolvedImage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect the docker image to get environment variables: %w", err)
+	}
+	result := make(map[string]string)
+	for _, s := range strings.Split(o, "\n") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		keyVal := strings.SplitN(s, "=", 2)
+		key := ""
+		val := ""
+		if len(keyVal) == 2 {
+			key, val = keyVal[0], keyVal[1]
+		} else if len(keyVal) == 1 {
+			// Something like 'KEY' with no '=' was specified. We assume value is blank.
+			key = keyVal[0]
+		}
+		if len(key) == 0 {
+			continue
+		}
+		result[key] = val
+	}
+	return result, nil
+}
+
+func (b *CLIBackend) CreateContainer(resolvedImage string, cmd []string, mounts []Mount) (string, error) {
+	a := []string{"create", "--rm"}
+	a = append(a, mountFlags(mounts)...)
+	a = append(a, resolvedImage)
+	a = append(a, cmd...)
+	o, err := runCmd(b.binPath, a...)
+	if err != nil {
+		return "", err
+	}
+	return trimContainerID(o)
+}
+
+// mountFlags renders mounts as repeated "-v src:dst[:ro]" docker/podman CLI flags.
+func mountFlags(mounts []Mount) []string {
+	var flags []string
+	for _, m := range mounts {
+		v := fmt.Sprintf("%s:%s", m.SourcePath, m.DestinationPath)
+		if m.ReadOnly {
+			v += ":ro"
+		}
+		flags = append(flags, "-v", v)
+	}
+	return flags
+}
+
+// trimContainerID trims whitespace from the stdout of a "create" command and sanity-checks that
+// what's left looks like a full container ID.
+func trimContainerID(o string) (string, error) {
+	cid := strings.TrimSpace(o)
+	if len(cid) != 64 {
+		return "", fmt.Errorf("container ID %q extracted from the stdout of the container create command had unexpected length, got %d, want 64", cid, len(cid))
+	}
+	return cid, nil
+}
+
+func (b *CLIBackend) StartContainer(containerID string) error {
+	_, err := runCmd(b.binPath, "start", containerID)
+	return err
+}
+
+func (b *CLIBackend) Exec(containerID, workdir, user string, env map[string]string, cmd string, args []string) (string, error) {
+	a := []string{"exec"}
+	if workdir != "" {
+		a = append(a, "-w", workdir)
+	}
+	if user != "" {
+		a = append(a, "-u", user)
+	}
+	for k, v := range env {
+		a = append(a, "-e", fmt.Sprintf("%s=%s", k, v))
+	}
+	a = append(a, containerID, cmd)
+	a = append(a, args...)
+	o, err := runCmd(b.binPath, a...)
+	return strings.TrimSpace(o), err
+}
+
+func (b *CLIBackend) ExecStreaming(ctx context.Context, containerID, workdir, user string, env map[string]string, stdout, stderr io.Writer, cmd string, args []string) (int, error) {
+	a := []string{"exec"}
+	if workdir != "" {
+		a = append(a, "-w", workdir)
+	}
+	if user != "" {
+		a = append(a, "-u", user)
+	}
+	for k, v := range env {
+		a = append(a, "-e", fmt.Sprintf("%s=%s", k, v))
+	}
+	a = append(a, containerID, cmd)
+	a = append(a, args...)
+	c := exec.CommandContext(ctx, b.binPath, a...)
+	c.Stdout = stdout
+	c.Stderr = stderr
+	err := c.Run()
+	if err == nil {
+		return 0, nil
+	}
+	if ctx.Err() != nil {
+		// ctx was canceled, which exec.CommandContext enforces by killing the process; that kill
+		// is also reported as an *exec.ExitError, so check for cancellation first or it would be
+		// indistinguishable from the command itself exiting non-zero.
+		return -1, ctx.Err()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// The CLI exited non-zero. This is returned as the exit code with a nil error, whether the
+		// command inside the container failed or the CLI itself failed after starting (e.g. the
+		// daemon was unreachable): the CLI's exit status alone does not tell the two apart.
+		return exitErr.ExitCode(), nil
+	}
+	return -1, fmt.Errorf("failed to exec %q in container %v: %w", cmd, containerID, err)
+}
+
+func (b *CLIBackend) CopyToContainer(containerID, src, dst string) error {
+	_, err := runCmd(b.binPath, "cp", src, fmt.Sprintf("%s:%s", containerID, dst))
+	return err
+}
+
+func (b *CLIBackend) CopyFromContainer(containerID, src, dst string) error {
+	_, err := runCmd(b.binPath, "cp", fmt.Sprintf("%s:%s", containerID, src), dst)
+	return err
+}
+
+func (b *CLIBackend) StopContainer(containerID string) error {
+	_, err := runCmd(b.binPath, "stop", "-t", "0", containerID)
+	return err
+}
+
+func (b *CLIBackend) CommitContainer(containerID, ref string, opts CommitOptions) (string, error) {
+	if opts.Squash {
+		return b.commitSquashed(containerID, ref, opts)
+	}
+	a := []string{"commit"}
+	if opts.Author != "" {
+		a = append(a, "--author", opts.Author)
+	}
+	if opts.Message != "" {
+		a = append(a, "--message", opts.Message)
+	}
+	for _, c := range commitChanges(opts) {
+		a = append(a, "--change", c)
+	}
+	a = append(a, containerID, ref)
+	o, err := runCmd(b.binPath, a...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(o), nil
+}
+
+// squashBaseConfig is the subset of "docker inspect"'s Config we need to carry forward when
+// assembling a squashed image, since "docker import" starts from a blank config and otherwise
+// drops everything the container inherited from its base image.
+type squashBaseConfig struct {
+	Cmd        []string
+	Entrypoint []string
+	Env        []string
+	WorkingDir string
+}
+
+// inspectContainerConfig returns containerID's effective config, which is seeded from its base
+// image's config at container-create time and reflects any CMD/ENTRYPOINT/ENV/WORKDIR it
+// inherited.
+func (b *CLIBackend) inspectContainerConfig(containerID string) (squashBaseConfig, error) {
+	o, err := runCmd(b.binPath, "inspect", "-f", "{{json .Config}}", containerID)
+	if err != nil {
+		return squashBaseConfig{}, fmt.Errorf("failed to inspect container %v config: %w", containerID, err)
+	}
+	var cfg squashBaseConfig
+	if err := json.Unmarshal([]byte(o), &cfg); err != nil {
+		return squashBaseConfig{}, fmt.Errorf("failed to parse container %v config: %w", containerID, err)
+	}
+	return cfg, nil
+}
+
+// commitSquashed flattens containerID's full filesystem into a single-layer image tagged ref.
+// "docker commit" only captures the container's own diff layer on top of its base image, so to
+// squash away the base image's history too we export the container's merged filesystem and
+// re-import it as a brand new, single-layer image. "docker import" starts from a blank config, so
+// opts is merged with the container's own inherited config before being reapplied as "--change"
+// on the import; otherwise the squashed image would lose its base image's ENV, WORKDIR, CMD and
+// ENTRYPOINT.
+func (b *CLIBackend) commitSquashed(containerID, ref string, opts CommitOptions) (string, error) {
+	baseCfg, err := b.inspectContainerConfig(containerID)
+	if err != nil {
+		return "", err
+	}
+	merged := mergeCommitOptions(baseCfg.Cmd, baseCfg.Entrypoint, baseCfg.Env, baseCfg.WorkingDir, opts)
+
+	tmp, err := ioutil.TempFile("", "bazel-toolchains-squash-*.tar")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file to hold squashed export of container %v: %w", containerID, err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if _, err := runCmd(b.binPath, "export", "-o", tmp.Name(), containerID); err != nil {
+		return "", fmt.Errorf("failed to export container %v for squashing: %w", containerID, err)
+	}
+	a := []string{"import"}
+	for _, c := range commitChanges(merged) {
+		a = append(a, "--change", c)
+	}
+	if merged.Message != "" {
+		a = append(a, "--message", merged.Message)
+	}
+	a = append(a, tmp.Name(), ref)
+	o, err := runCmd(b.binPath, a...)
+	if err != nil {
+		return "", fmt.Errorf("failed to import squashed image %q: %w", ref, err)
+	}
+	return strings.TrimSpace(o), nil
+}
+
+func (b *CLIBackend) PushImage(ref string, auth AuthConfig) error {
+	if auth.Username != "" {
+		loginArgs := []string{"login", "-u", auth.Username, "-p", auth.Password}
+		if auth.ServerAddress != "" {
+			loginArgs = append(loginArgs, auth.ServerAddress)
+		}
+		if _, err := runCmd(b.binPath, loginArgs...); err != nil {
+			return fmt.Errorf("failed to authenticate with registry %q: %w", auth.ServerAddress, err)
+		}
+	}
+	_, err := runCmd(b.binPath, "push", ref)
+	return err
+}
@@ -0,0 +1,373 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// DaemonBackend implements Backend against a running docker daemon using the official Docker
+// Engine API client, instead of shelling out to the docker CLI. This gives us structured errors
+// instead of scraped CLI text (container ID lengths, RepoDigests indexing) and access to the
+// daemon's streaming APIs.
+type DaemonBackend struct {
+	cli *client.Client
+}
+
+// NewDaemonBackend connects to the docker daemon using the standard DOCKER_HOST/DOCKER_* env
+// configuration and returns a Backend that talks to it over the API.
+func NewDaemonBackend() (*DaemonBackend, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create docker API client: %w", err)
+	}
+	return &DaemonBackend{cli: cli}, nil
+}
+
+// reachable reports whether the daemon actually answers over the configured socket.
+// NewDaemonBackend succeeding only means the client's own configuration (DOCKER_HOST etc.) parsed;
+// it doesn't dial anything, so callers deciding whether to fall back to a CLIBackend need this
+// separate, bounded check.
+func (b *DaemonBackend) reachable() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := b.cli.Ping(ctx)
+	return err == nil
+}
+
+func (b *DaemonBackend) PullImage(containerImage string) error {
+	ctx := context.Background()
+	rc, err := b.cli.ImagePull(ctx, containerImage, types.ImagePullOptions{})
+	if err != nil {
+		return fmt.Errorf("docker was unable to pull the toolchain container image %q: %w", containerImage, err)
+	}
+	defer rc.Close()
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		return fmt.Errorf("failed to read pull progress for toolchain container image %q: %w", containerImage, err)
+	}
+	return nil
+}
+
+func (b *DaemonBackend) InspectImage(containerImage string) (string, error) {
+	ctx := context.Background()
+	inspect, _, err := b.cli.ImageInspectWithRaw(ctx, containerImage)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert toolchain container image %q into a fully qualified image name by digest: %w", containerImage, err)
+	}
+	if len(inspect.RepoDigests) == 0 {
+		return "", fmt.Errorf("toolchain container image %q has no RepoDigests; was it pulled from a registry?", containerImage)
+	}
+	return inspect.RepoDigests[0], nil
+}
+
+func (b *DaemonBackend) ImageEnv(resolvedImage string) (map[string]string, error) {
+	ctx := context.Background()
+	inspect, _, err := b.cli.ImageInspectWithRaw(ctx, resolvedImage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect the toolchain container image to get environment variables: %w", err)
+	}
+	result := make(map[string]string)
+	if inspect.Config == nil {
+		return result, nil
+	}
+	for _, e := range inspect.Config.Env {
+		keyVal := strings.SplitN(e, "=", 2)
+		if keyVal[0] == "" {
+			continue
+		}
+		val := ""
+		if len(keyVal) == 2 {
+			val = keyVal[1]
+		}
+		result[keyVal[0]] = val
+	}
+	return result, nil
+}
+
+func (b *DaemonBackend) CreateContainer(resolvedImage string, cmd []string, mounts []Mount) (string, error) {
+	ctx := context.Background()
+	var binds []string
+	for _, m := range mounts {
+		bind := fmt.Sprintf("%s:%s", m.SourcePath, m.DestinationPath)
+		if m.ReadOnly {
+			bind += ":ro"
+		}
+		binds = append(binds, bind)
+	}
+	resp, err := b.cli.ContainerCreate(ctx, &container.Config{
+		Image: resolvedImage,
+		Cmd:   cmd,
+	}, &container.HostConfig{
+		AutoRemove: true,
+		Binds:      binds,
+	}, nil, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create a container with the toolchain container image: %w", err)
+	}
+	return resp.ID, nil
+}
+
+func (b *DaemonBackend) StartContainer(containerID string) error {
+	ctx := context.Background()
+	if err := b.cli.ContainerStart(ctx, containerID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("failed to run the toolchain container: %w", err)
+	}
+	return nil
+}
+
+func (b *DaemonBackend) Exec(containerID, workdir, user string, env map[string]string, cmd string, args []string) (string, error) {
+	ctx := context.Background()
+	var envList []string
+	for k, v := range env {
+		envList = append(envList, fmt.Sprintf("%s=%s", k, v))
+	}
+	execConfig := types.ExecConfig{
+		Cmd:          append([]string{cmd}, args...),
+		Env:          envList,
+		WorkingDir:   workdir,
+		User:         user,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	execID, err := b.cli.ContainerExecCreate(ctx, containerID, execConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to create exec in container %v: %w", containerID, err)
+	}
+	resp, err := b.cli.ContainerExecAttach(ctx, execID.ID, types.ExecStartCheck{})
+	if err != nil {
+		return "", fmt.Errorf("failed to attach to exec in container %v: %w", containerID, err)
+	}
+	defer resp.Close()
+	// ExecConfig.Tty is unset (false), so the daemon multiplexes stdout/stderr over the attach
+	// stream with 8-byte stdcopy frame headers; read it raw and the result is binary framing, not
+	// clean output. Demux it the same way ExecStreaming does and keep only stdout, matching what
+	// callers (mkdir, GetEnv parsing, trimmed introspection output) expect.
+	var stdout bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, io.Discard, resp.Reader); err != nil {
+		return "", fmt.Errorf("failed to read exec output from container %v: %w", containerID, err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (b *DaemonBackend) ExecStreaming(ctx context.Context, containerID, workdir, user string, env map[string]string, stdout, stderr io.Writer, cmd string, args []string) (int, error) {
+	var envList []string
+	for k, v := range env {
+		envList = append(envList, fmt.Sprintf("%s=%s", k, v))
+	}
+	execConfig := types.ExecConfig{
+		Cmd:          append([]string{cmd}, args...),
+		Env:          envList,
+		WorkingDir:   workdir,
+		User:         user,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	execID, err := b.cli.ContainerExecCreate(ctx, containerID, execConfig)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create exec in container %v: %w", containerID, err)
+	}
+	resp, err := b.cli.ContainerExecAttach(ctx, execID.ID, types.ExecStartCheck{})
+	if err != nil {
+		return -1, fmt.Errorf("failed to attach to exec in container %v: %w", containerID, err)
+	}
+	defer resp.Close()
+	copyDone := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(stdout, stderr, resp.Reader)
+		copyDone <- err
+	}()
+	select {
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	case err := <-copyDone:
+		if err != nil {
+			return -1, fmt.Errorf("failed to stream exec output from container %v: %w", containerID, err)
+		}
+	}
+	inspect, err := b.cli.ContainerExecInspect(ctx, execID.ID)
+	if err != nil {
+		return -1, fmt.Errorf("failed to inspect exec result of container %v: %w", containerID, err)
+	}
+	return inspect.ExitCode, nil
+}
+
+func (b *DaemonBackend) CopyToContainer(containerID, src, dst string) error {
+	ctx := context.Background()
+	srcInfo, err := archive.CopyInfoSourcePath(src, false)
+	if err != nil {
+		return fmt.Errorf("failed to stat local path %q: %w", src, err)
+	}
+	srcArchive, err := archive.TarResource(srcInfo)
+	if err != nil {
+		return fmt.Errorf("failed to archive local path %q: %w", src, err)
+	}
+	defer srcArchive.Close()
+	dstDir, preparedArchive, err := archive.PrepareArchiveCopy(srcArchive, srcInfo, archive.CopyInfo{Path: dst})
+	if err != nil {
+		return fmt.Errorf("failed to prepare archive copy to %q: %w", dst, err)
+	}
+	defer preparedArchive.Close()
+	if err := b.cli.CopyToContainer(ctx, containerID, dstDir, preparedArchive, types.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("failed to copy %q to container %v:%q: %w", src, containerID, dst, err)
+	}
+	return nil
+}
+
+func (b *DaemonBackend) CopyFromContainer(containerID, src, dst string) error {
+	ctx := context.Background()
+	rc, _, err := b.cli.CopyFromContainer(ctx, containerID, src)
+	if err != nil {
+		return fmt.Errorf("failed to copy %q from container %v: %w", src, containerID, err)
+	}
+	defer rc.Close()
+
+	// "docker cp containerID:src dst" treats an existing dst directory as a target to place src
+	// inside, and any other dst as the exact file/dir name to create. Match that: if dst already
+	// exists and is a directory, untar straight into it; otherwise untar into dst's parent and
+	// rename the extracted entry (named after src's basename on the wire) to dst.
+	untarDir := dst
+	renameTo := ""
+	if fi, statErr := os.Stat(dst); statErr != nil || !fi.IsDir() {
+		untarDir = filepath.Dir(dst)
+		renameTo = dst
+	}
+	if err := archive.Untar(rc, untarDir, &archive.TarOptions{}); err != nil {
+		return fmt.Errorf("failed to extract archive copied from container %v:%q: %w", containerID, src, err)
+	}
+	if renameTo == "" {
+		return nil
+	}
+	extracted := filepath.Join(untarDir, filepath.Base(src))
+	if extracted == renameTo {
+		return nil
+	}
+	if err := os.Rename(extracted, renameTo); err != nil {
+		return fmt.Errorf("failed to rename %q to %q after extracting archive copied from container %v:%q: %w", extracted, renameTo, containerID, src, err)
+	}
+	return nil
+}
+
+func (b *DaemonBackend) StopContainer(containerID string) error {
+	ctx := context.Background()
+	if err := b.cli.ContainerStop(ctx, containerID, container.StopOptions{}); err != nil {
+		return fmt.Errorf("failed to stop container %v: %w", containerID, err)
+	}
+	return nil
+}
+
+func (b *DaemonBackend) CommitContainer(containerID, ref string, opts CommitOptions) (string, error) {
+	ctx := context.Background()
+	if opts.Squash {
+		return b.commitSquashed(ctx, containerID, ref, opts)
+	}
+	resp, err := b.cli.ContainerCommit(ctx, containerID, types.ContainerCommitOptions{
+		Reference: ref,
+		Comment:   opts.Message,
+		Author:    opts.Author,
+		Changes:   commitChanges(opts),
+		Pause:     true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to commit container %v to image %q: %w", containerID, ref, err)
+	}
+	return resp.ID, nil
+}
+
+// commitSquashed mirrors CLIBackend's export/import squashing using the Engine API: the daemon's
+// commit endpoint only ever captures the container's own diff layer on top of its base image, with
+// no server-side equivalent of "docker build --squash", so we export the container's merged
+// filesystem and import it as a brand new, single-layer image instead. The import starts from a
+// blank config, so opts is merged with the container's own inherited config first, same as
+// CLIBackend, or the squashed image would lose its base image's ENV, WORKDIR, CMD and ENTRYPOINT.
+func (b *DaemonBackend) commitSquashed(ctx context.Context, containerID, ref string, opts CommitOptions) (string, error) {
+	inspect, err := b.cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect container %v for squashing: %w", containerID, err)
+	}
+	var baseCmd, baseEntrypoint, baseEnv []string
+	var baseWorkdir string
+	if inspect.Config != nil {
+		baseCmd = inspect.Config.Cmd
+		baseEntrypoint = []string(inspect.Config.Entrypoint)
+		baseEnv = inspect.Config.Env
+		baseWorkdir = inspect.Config.WorkingDir
+	}
+	merged := mergeCommitOptions(baseCmd, baseEntrypoint, baseEnv, baseWorkdir, opts)
+
+	rc, err := b.cli.ContainerExport(ctx, containerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to export container %v for squashing: %w", containerID, err)
+	}
+	defer rc.Close()
+	importResp, err := b.cli.ImageImport(ctx, types.ImageImportSource{Source: rc, SourceName: "-"}, ref, types.ImageImportOptions{
+		Message: merged.Message,
+		Changes: commitChanges(merged),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to import squashed image %q: %w", ref, err)
+	}
+	defer importResp.Close()
+	if _, err := io.Copy(ioutil.Discard, importResp); err != nil {
+		return "", fmt.Errorf("failed to read squashed image import progress for %q: %w", ref, err)
+	}
+	// ImageImport's response is a stream of progress messages, not the new image's ID, so resolve
+	// it with a follow-up inspect. Unlike InspectImage (which resolves a fully qualified reference
+	// by RepoDigests for pulling), we want the locally assigned ID here, which is always present
+	// even for an image that's never been pushed.
+	inspectImg, _, err := b.cli.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve image ID for squashed image %q: %w", ref, err)
+	}
+	return inspectImg.ID, nil
+}
+
+func (b *DaemonBackend) PushImage(ref string, auth AuthConfig) error {
+	ctx := context.Background()
+	authJSON, err := json.Marshal(types.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		ServerAddress: auth.ServerAddress,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode push credentials for %q: %w", ref, err)
+	}
+	rc, err := b.cli.ImagePush(ctx, ref, types.ImagePushOptions{
+		RegistryAuth: base64.URLEncoding.EncodeToString(authJSON),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to push image %q: %w", ref, err)
+	}
+	defer rc.Close()
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		return fmt.Errorf("failed to read push progress for image %q: %w", ref, err)
+	}
+	return nil
+}
@@ -15,10 +15,11 @@
 package runner
 
 import (
+	"context"
 	"fmt"
 	"github.com/bazelbuild/bazel-toolchains/pkg/options"
+	"io"
 	"log"
-	"strings"
 )
 
 // workdir returns the root working directory to use inside the toolchain container for the given
@@ -53,51 +54,62 @@ type DockerRunner struct {
 	workdir string
 	// additionalEnv is the environment variables to set when executing commands
 	additionalEnv map[string]string
+	// user, if non-empty, is the user (and optionally group, as "user:group") that commands are
+	// executed as inside the container, overriding the image's default user.
+	user string
+	// transientMounts are host paths bind-mounted into the container. Since most container
+	// engines can't add mounts to an already running container, setting these via
+	// SetTransientMounts recreates the container.
+	transientMounts []Mount
 
 	// Populated by the Runner.
-	// dockerPath is the path to the docker client.
-	dockerPath string
+	// backend is the Backend used to pull images and create/drive/stop the running container.
+	backend Backend
 	// containerID is the ID of the running docker container.
 	containerID string
 	// ResolvedImage is the container image referenced by its sha256 digest.
 	ResolvedImage string
 }
 
-// NewDockerRunner creates a new running container of the given containerImage. stopContainer
+// defaultBackend returns the Backend to use when a caller doesn't supply one: a DaemonBackend
+// talking to the Engine API when the docker daemon socket is actually reachable, so callers get
+// structured errors and streaming instead of CLI text-scraping, falling back to a CLIBackend
+// driving the "docker" binary when it isn't.
+func defaultBackend() Backend {
+	if b, err := NewDaemonBackend(); err == nil && b.reachable() {
+		return b
+	}
+	return NewCLIBackend("docker")
+}
+
+// NewDockerRunner creates a new running container of the given containerImage using backend to
+// talk to the container engine. If backend is nil, defaultBackend is used. stopContainer
 // determines if the Cleanup function on the DockerRunner will stop the running container when
 // called.
-func NewDockerRunner(containerImage string, stopContainer bool, execOS string) (*DockerRunner, error) {
+func NewDockerRunner(containerImage string, stopContainer bool, execOS string, backend Backend) (*DockerRunner, error) {
 	if containerImage == "" {
 		return nil, fmt.Errorf("container image was not specified")
 	}
+	if backend == nil {
+		backend = defaultBackend()
+	}
 	d := &DockerRunner{
 		containerImage: containerImage,
 		stopContainer:  stopContainer,
-		dockerPath:     "docker",
+		backend:        backend,
 	}
-	if _, err := runCmd(d.dockerPath, "pull", d.containerImage); err != nil {
+	if err := d.backend.PullImage(d.containerImage); err != nil {
 		return nil, fmt.Errorf("docker was unable to pull the toolchain container image %q: %w", d.containerImage, err)
 	}
-	resolvedImage, err := runCmd(d.dockerPath, "inspect", "--format={{index .RepoDigests 0}}", d.containerImage)
+	resolvedImage, err := d.backend.InspectImage(d.containerImage)
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert toolchain container image %q into a fully qualified image name by digest: %w", d.containerImage, err)
 	}
-	resolvedImage = strings.TrimSpace(resolvedImage)
 	log.Printf("Resolved toolchain image %q to fully qualified reference %q.", d.containerImage, resolvedImage)
 	d.ResolvedImage = resolvedImage
 
-	cid, err := runCmd(d.dockerPath, "create", "--rm", d.ResolvedImage, "sleep", "infinity")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create a container with the toolchain container image: %w", err)
-	}
-	cid = strings.TrimSpace(cid)
-	if len(cid) != 64 {
-		return nil, fmt.Errorf("container ID %q extracted from the stdout of the container create command had unexpected length, got %d, want 64", cid, len(cid))
-	}
-	d.containerID = cid
-	log.Printf("Created container ID %v for toolchain container image %v.", d.containerID, d.ResolvedImage)
-	if _, err := runCmd(d.dockerPath, "start", d.containerID); err != nil {
-		return nil, fmt.Errorf("failed to run the toolchain container: %w", err)
+	if err := d.createAndStartContainer(); err != nil {
+		return nil, err
 	}
 	if _, err := d.ExecCmd("mkdir", workdir(execOS)); err != nil {
 		d.Cleanup()
@@ -107,21 +119,58 @@ func NewDockerRunner(containerImage string, stopContainer bool, execOS string) (
 	return d, nil
 }
 
+// createAndStartContainer creates a fresh container for d.ResolvedImage, bind-mounting any
+// transient mounts currently set, and starts it.
+func (d *DockerRunner) createAndStartContainer() error {
+	cid, err := d.backend.CreateContainer(d.ResolvedImage, []string{"sleep", "infinity"}, d.transientMounts)
+	if err != nil {
+		return fmt.Errorf("failed to create a container with the toolchain container image: %w", err)
+	}
+	d.containerID = cid
+	log.Printf("Created container ID %v for toolchain container image %v.", d.containerID, d.ResolvedImage)
+	if err := d.backend.StartContainer(d.containerID); err != nil {
+		return fmt.Errorf("failed to run the toolchain container: %w", err)
+	}
+	return nil
+}
+
+// SetTransientMounts replaces the running container with one created with the given host mounts
+// bind-mounted in, preserving the current workdir. docker exec can't add mounts to an already
+// running container, so mounts must be baked in at container-create time; callers that need
+// local SDKs, caches or credentials visible to ExecCmd should call this before issuing commands
+// that depend on them. Mounted content is not part of the final extracted config or any later
+// Commit of the container, so it's safe to use for material that must not end up in the image.
+func (d *DockerRunner) SetTransientMounts(mounts []Mount) error {
+	d.transientMounts = mounts
+	if err := d.backend.StopContainer(d.containerID); err != nil {
+		log.Printf("Failed to stop container %v of toolchain image %v before recreating it with transient mounts; continuing anyway.", d.containerID, d.ResolvedImage)
+	}
+	if err := d.createAndStartContainer(); err != nil {
+		return fmt.Errorf("failed to recreate toolchain container with transient mounts: %w", err)
+	}
+	if d.workdir != "" {
+		if _, err := d.ExecCmd("mkdir", "-p", d.workdir); err != nil {
+			return fmt.Errorf("failed to recreate workdir %q in toolchain container after setting transient mounts: %w", d.workdir, err)
+		}
+	}
+	return nil
+}
+
 // execCmd runs the given command inside the docker container and returns the output with whitespace
 // trimmed from the edges.
 func (d *DockerRunner) ExecCmd(cmd string, args ...string) (string, error) {
-	a := []string{"exec"}
-	if d.workdir != "" {
-		a = append(a, "-w", d.workdir)
-	}
-	for _, e := range convertAdditionalEnv(d) {
-		a = append(a, "-e", e)
-	}
-	a = append(a, d.containerID)
-	a = append(a, cmd)
-	a = append(a, args...)
-	o, err := runCmd(d.dockerPath, a...)
-	return strings.TrimSpace(o), err
+	return d.backend.Exec(d.containerID, d.workdir, d.user, d.additionalEnv, cmd, args)
+}
+
+// ExecCmdStreaming runs the given command inside the docker container, streaming its stdout and
+// stderr to the given writers as it runs instead of buffering the whole output, and honoring ctx
+// for cancellation. Unlike ExecCmd, a command that runs but exits non-zero is reported via
+// exitCode rather than err: err is reserved for failures to run or stream the command at all
+// (e.g. the daemon or CLI becoming unreachable), so callers can tell a retryable infrastructure
+// failure from a genuine tool error. With CLIBackend and PodmanBackend, a failure of the CLI that
+// ends in a non-zero exit status (such as an unreachable daemon) is reported as exitCode instead.
+func (d *DockerRunner) ExecCmdStreaming(ctx context.Context, stdout, stderr io.Writer, cmd string, args ...string) (exitCode int, err error) {
+	return d.backend.ExecStreaming(ctx, d.containerID, d.workdir, d.user, d.additionalEnv, stdout, stderr, cmd, args)
 }
 
 // cleanup stops the running container if stopContainer was true when the DockerRunner was created.
@@ -130,7 +179,7 @@ func (d *DockerRunner) Cleanup() {
 		log.Printf("Not stopping container %v of image %v because the Cleanup option was set to false.", d.containerID, d.ResolvedImage)
 		return
 	}
-	if _, err := runCmd(d.dockerPath, "stop", "-t", "0", d.containerID); err != nil {
+	if err := d.backend.StopContainer(d.containerID); err != nil {
 		log.Printf("Failed to stop container %v of toolchain image %v but it's ok to ignore this error if config generation & extraction succeeded.", d.containerID, d.ResolvedImage)
 	}
 }
@@ -138,19 +187,13 @@ func (d *DockerRunner) Cleanup() {
 // copyTo copies the local file at 'src' to the container where 'dst' is the path inside
 // the container. d.workdir has no impact on this function.
 func (d *DockerRunner) CopyTo(src, dst string) error {
-	if _, err := runCmd(d.dockerPath, "cp", src, fmt.Sprintf("%s:%s", d.containerID, dst)); err != nil {
-		return err
-	}
-	return nil
+	return d.backend.CopyToContainer(d.containerID, src, dst)
 }
 
 // copyFrom extracts the file at 'src' from inside the container and copies it to the path
 // 'dst' locally. d.workdir has no impact on this function.
 func (d *DockerRunner) CopyFrom(src, dst string) error {
-	if _, err := runCmd(d.dockerPath, "cp", fmt.Sprintf("%s:%s", d.containerID, src), dst); err != nil {
-		return err
-	}
-	return nil
+	return d.backend.CopyFromContainer(d.containerID, src, dst)
 }
 
 // getEnv gets the shell environment values from the toolchain container as determined by the
@@ -159,32 +202,28 @@ func (d *DockerRunner) CopyFrom(src, dst string) error {
 // The return value of this function is a map from env keys to their values. If the image config,
 // specifies the same env key multiple times, later values supercede earlier ones.
 func (d *DockerRunner) GetEnv() (map[string]string, error) {
-	result := make(map[string]string)
-	o, err := runCmd(d.dockerPath, "inspect", "-f", "{{range $i, $v := .Config.Env}}{{println $v}}{{end}}", d.ResolvedImage)
+	return d.backend.ImageEnv(d.ResolvedImage)
+}
+
+// Commit snapshots the running container as a new image tagged ref, applying opts, and returns
+// the ID of the committed image (the image is only tagged locally at this point, so a registry
+// digest isn't available until after Push). This lets callers capture a toolchain container whose
+// state was modified by their extraction scripts (e.g. installed packages, generated wrapper
+// scripts) so it can be pushed and reused as a pinned, reproducible container_image reference.
+func (d *DockerRunner) Commit(ref string, opts CommitOptions) (string, error) {
+	imageID, err := d.backend.CommitContainer(d.containerID, ref, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to inspect the docker image to get environment variables: %w", err)
+		return "", fmt.Errorf("failed to commit toolchain container %v to image %q: %w", d.containerID, ref, err)
 	}
-	split := strings.Split(o, "\n")
-	for _, s := range split {
-		s = strings.TrimSpace(s)
-		if len(s) == 0 {
-			continue
-		}
-		keyVal := strings.SplitN(s, "=", 2)
-		key := ""
-		val := ""
-		if len(keyVal) == 2 {
-			key, val = keyVal[0], keyVal[1]
-		} else if len(keyVal) == 1 {
-			// Maybe something like 'KEY=' was specified. We assume value is blank.
-			key = keyVal[0]
-		}
-		if len(key) == 0 {
-			continue
-		}
-		result[key] = val
+	return imageID, nil
+}
+
+// Push pushes ref, which must already have been produced by Commit, to its registry using auth.
+func (d *DockerRunner) Push(ref string, auth AuthConfig) error {
+	if err := d.backend.PushImage(ref, auth); err != nil {
+		return fmt.Errorf("failed to push image %q: %w", ref, err)
 	}
-	return result, nil
+	return nil
 }
 
 func (d *DockerRunner) GetWorkdir() string {
@@ -202,3 +241,15 @@ func (d *DockerRunner) GetAdditionalEnv() map[string]string {
 func (d *DockerRunner) SetAdditionalEnv(env map[string]string) {
 	d.additionalEnv = env
 }
+
+// GetUser returns the user that commands are currently executed as, or "" to use the image's
+// default user.
+func (d *DockerRunner) GetUser() string {
+	return d.user
+}
+
+// SetUser sets the user (and optionally group, as "user:group") that subsequent ExecCmd and
+// ExecCmdStreaming calls run as inside the container.
+func (d *DockerRunner) SetUser(user string) {
+	d.user = user
+}
@@ -0,0 +1,34 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package runner
+
+import (
+	"fmt"
+
+	"github.com/bazelbuild/bazel-toolchains/pkg/options"
+)
+
+// NewRunner creates a new running container of the given containerImage using the container
+// engine selected by rt (--runtime). stopContainer determines if the Cleanup function on the
+// returned Runner will stop the running container when called.
+func NewRunner(containerImage string, stopContainer bool, execOS string, rt options.Runtime) (Runner, error) {
+	switch rt {
+	case "", options.RuntimeDocker:
+		return NewDockerRunner(containerImage, stopContainer, execOS, nil)
+	case options.RuntimePodman:
+		return NewPodmanRunner(containerImage, stopContainer, execOS, true)
+	}
+	return nil, fmt.Errorf("unsupported runtime %q", rt)
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package runner
+
+// PodmanBackend implements Backend by shelling out to the podman CLI. It behaves like CLIBackend
+// but passes podman-specific flags (e.g. --userns=keep-id) so rootless hosts without a Docker
+// daemon can still generate toolchain configs.
+type PodmanBackend struct {
+	*CLIBackend
+	// keepIDUserns, when true, passes --userns=keep-id to "podman create" so that files written
+	// by the in-container user map back to the invoking host user (useful when CopyFrom is used
+	// to pull generated files back out as the calling user).
+	keepIDUserns bool
+}
+
+// NewPodmanBackend returns a Backend that drives containers via the podman binary. keepIDUserns
+// controls whether created containers are given --userns=keep-id.
+func NewPodmanBackend(keepIDUserns bool) *PodmanBackend {
+	return &PodmanBackend{
+		CLIBackend:   NewCLIBackend("podman"),
+		keepIDUserns: keepIDUserns,
+	}
+}
+
+func (b *PodmanBackend) CreateContainer(resolvedImage string, cmd []string, mounts []Mount) (string, error) {
+	a := []string{"create", "--rm"}
+	if b.keepIDUserns {
+		a = append(a, "--userns=keep-id")
+	}
+	a = append(a, mountFlags(mounts)...)
+	a = append(a, resolvedImage)
+	a = append(a, cmd...)
+	o, err := runCmd(b.binPath, a...)
+	if err != nil {
+		return "", err
+	}
+	return trimContainerID(o)
+}
@@ -0,0 +1,34 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package runner
+
+// PodmanRunner implements the same Runner interface as DockerRunner, but drives containers
+// through podman instead of docker, so it works on rootless/daemonless hosts. Workdir setup, env
+// injection, CopyTo/CopyFrom and ResolvedImage all behave exactly as they do for DockerRunner;
+// PodmanRunner only changes how the underlying container is created and driven.
+type PodmanRunner struct {
+	*DockerRunner
+}
+
+// NewPodmanRunner creates a new running container of the given containerImage using podman.
+// keepIDUserns controls whether the container is created with --userns=keep-id, which is useful
+// on rootless hosts so files copied out via CopyFrom are owned by the invoking user.
+func NewPodmanRunner(containerImage string, stopContainer bool, execOS string, keepIDUserns bool) (*PodmanRunner, error) {
+	d, err := NewDockerRunner(containerImage, stopContainer, execOS, NewPodmanBackend(keepIDUserns))
+	if err != nil {
+		return nil, err
+	}
+	return &PodmanRunner{DockerRunner: d}, nil
+}